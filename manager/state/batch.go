@@ -0,0 +1,108 @@
+package state
+
+import (
+	"time"
+
+	"github.com/docker/swarm-v2/api"
+)
+
+// pendingProposal is one caller's contribution to a raft proposal,
+// waiting on n.proposeQueue to be picked up by the batcher.
+type pendingProposal struct {
+	id     uint64
+	action []*api.StoreAction
+}
+
+// runProposer coalesces everything available on n.proposeQueue into
+// batched InternalRaftRequests. It runs for the lifetime of the node. It
+// closes proposerDoneCh on exit so Shutdown can wait for a batch in
+// flight to finish submitting before tearing down n.Node.
+func (n *Node) runProposer() {
+	defer close(n.proposerDoneCh)
+
+	var carry *pendingProposal
+	for {
+		var first *pendingProposal
+		if carry != nil {
+			first = carry
+			carry = nil
+		} else {
+			select {
+			case first = <-n.proposeQueue:
+			case <-n.stopCh:
+				return
+			}
+		}
+
+		carry = n.proposeBatch(first)
+	}
+}
+
+// proposeBatch collects proposals starting from first, up to
+// maxRequestBytes or n.maxBatchDelay, and submits them as one raft
+// proposal. A proposal that would overflow maxRequestBytes is returned
+// as carry instead of being dropped.
+func (n *Node) proposeBatch(first *pendingProposal) (carry *pendingProposal) {
+	req := &api.InternalRaftRequest{
+		Records: []*api.RaftRequestRecord{{ID: first.id, Action: first.action}},
+	}
+	size := req.Size()
+	batch := []*pendingProposal{first}
+
+	deadline := time.NewTimer(n.maxBatchDelay)
+	defer deadline.Stop()
+
+collect:
+	for {
+		select {
+		case next := <-n.proposeQueue:
+			record := &api.RaftRequestRecord{ID: next.id, Action: next.action}
+			if batchOverflows(size, record.Size()) {
+				carry = next
+				break collect
+			}
+			req.Records = append(req.Records, record)
+			batch = append(batch, next)
+			size += record.Size()
+		case <-deadline.C:
+			break collect
+		case <-n.stopCh:
+			break collect
+		}
+	}
+
+	n.submitBatch(req, batch)
+	return carry
+}
+
+// submitBatch proposes req to raft on behalf of every proposal in batch,
+// canceling their waits if it can't be proposed at all.
+func (n *Node) submitBatch(req *api.InternalRaftRequest, batch []*pendingProposal) {
+	if !n.IsLeader() {
+		n.cancelBatch(batch)
+		return
+	}
+
+	data, err := req.Marshal()
+	if err != nil {
+		n.cancelBatch(batch)
+		return
+	}
+
+	if err := n.Propose(n.Ctx, data); err != nil {
+		n.cancelBatch(batch)
+		return
+	}
+}
+
+func (n *Node) cancelBatch(batch []*pendingProposal) {
+	for _, p := range batch {
+		n.wait.cancel(p.id)
+	}
+}
+
+// batchOverflows reports whether adding a recordSize-byte record to a
+// batch that's already size bytes would push it past maxRequestBytes.
+func batchOverflows(size, recordSize int) bool {
+	return size+recordSize > maxRequestBytes
+}
@@ -0,0 +1,190 @@
+package state
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/coreos/etcd/raft"
+	"github.com/docker/swarm-v2/api"
+	"golang.org/x/net/context"
+)
+
+func TestBatchOverflows(t *testing.T) {
+	cases := []struct {
+		size, recordSize int
+		overflow         bool
+	}{
+		{size: 0, recordSize: 10, overflow: false},
+		{size: maxRequestBytes - 1, recordSize: 1, overflow: false},
+		{size: maxRequestBytes, recordSize: 1, overflow: true},
+		{size: maxRequestBytes - 1, recordSize: 2, overflow: true},
+	}
+
+	for _, c := range cases {
+		if got := batchOverflows(c.size, c.recordSize); got != c.overflow {
+			t.Errorf("batchOverflows(%d, %d) = %v, want %v", c.size, c.recordSize, got, c.overflow)
+		}
+	}
+}
+
+// fakeRaftNode is a minimal raft.Node stub that lets tests drive
+// submitBatch/proposeBatch without a real raft instance. It embeds a nil
+// raft.Node so any method beyond Status and Propose panics if a test
+// exercises it, which means the test's assumptions about what the
+// proposer touches were wrong.
+type fakeRaftNode struct {
+	raft.Node
+
+	lead uint64
+
+	mu        sync.Mutex
+	proposals int
+}
+
+func (f *fakeRaftNode) Status() raft.Status {
+	return raft.Status{SoftState: raft.SoftState{Lead: f.lead}}
+}
+
+func (f *fakeRaftNode) Propose(ctx context.Context, data []byte) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.proposals++
+	return nil
+}
+
+func newTestProposerNode(leader bool) *Node {
+	var lead uint64
+	if leader {
+		lead = 1
+	}
+
+	n := &Node{
+		Config:        &raft.Config{ID: 1},
+		Ctx:           context.Background(),
+		Node:          &fakeRaftNode{lead: lead},
+		proposeQueue:  make(chan *pendingProposal),
+		stopCh:        make(chan struct{}),
+		maxBatchDelay: 50 * time.Millisecond,
+	}
+	n.wait = newWait()
+	return n
+}
+
+func TestProposeBatchCoalescesQueuedProposals(t *testing.T) {
+	n := newTestProposerNode(true)
+	fake := n.Node.(*fakeRaftNode)
+
+	second := &pendingProposal{id: 2, action: []*api.StoreAction{{}}}
+	go func() { n.proposeQueue <- second }()
+
+	first := &pendingProposal{id: 1, action: []*api.StoreAction{{}}}
+	if carry := n.proposeBatch(first); carry != nil {
+		t.Fatalf("proposeBatch returned unexpected carry %+v", carry)
+	}
+
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	if fake.proposals != 1 {
+		t.Fatalf("submitBatch issued %d Propose calls, want the two queued proposals combined into 1", fake.proposals)
+	}
+}
+
+func TestProposeBatchCarriesOverflowingProposalForward(t *testing.T) {
+	n := newTestProposerNode(true)
+	fake := n.Node.(*fakeRaftNode)
+
+	// Figure out, from the real encoded size, how many empty actions it
+	// takes to push a record past maxRequestBytes, rather than hardcoding
+	// an assumption about api.StoreAction's wire size.
+	empty := (&api.RaftRequestRecord{ID: 1}).Size()
+	withOne := (&api.RaftRequestRecord{ID: 1, Action: []*api.StoreAction{{}}}).Size()
+	perAction := withOne - empty
+	if perAction <= 0 {
+		t.Fatal("could not determine the encoded size of a single StoreAction")
+	}
+	count := maxRequestBytes/perAction + 1
+
+	overflowing := make([]*api.StoreAction, count)
+	for i := range overflowing {
+		overflowing[i] = &api.StoreAction{}
+	}
+
+	first := &pendingProposal{id: 1, action: []*api.StoreAction{{}}}
+	second := &pendingProposal{id: 2, action: overflowing}
+	go func() { n.proposeQueue <- second }()
+
+	carry := n.proposeBatch(first)
+	if carry != second {
+		t.Fatalf("proposeBatch did not carry the overflowing proposal forward, got %+v", carry)
+	}
+
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	if fake.proposals != 1 {
+		t.Fatalf("submitBatch issued %d Propose calls, want 1 for the non-overflowing proposal", fake.proposals)
+	}
+}
+
+func TestSubmitBatchCancelsWaitersWhenNotLeader(t *testing.T) {
+	n := newTestProposerNode(false)
+	fake := n.Node.(*fakeRaftNode)
+
+	const id = uint64(42)
+	ch := n.wait.register(id, nil)
+
+	n.submitBatch(&api.InternalRaftRequest{}, []*pendingProposal{{id: id}})
+
+	select {
+	case _, ok := <-ch:
+		if ok {
+			t.Fatal("expected cancelBatch to close the registered wait channel")
+		}
+	default:
+		t.Fatal("cancelBatch did not close the registered wait channel")
+	}
+
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	if fake.proposals != 0 {
+		t.Fatal("submitBatch called Propose while not the leader")
+	}
+}
+
+func TestRunProposerClosesDoneChOnStop(t *testing.T) {
+	n := &Node{
+		proposeQueue:   make(chan *pendingProposal),
+		stopCh:         make(chan struct{}),
+		proposerDoneCh: make(chan struct{}),
+	}
+
+	// No proposal is ever queued, so if runProposer reached submitBatch it
+	// would panic on the nil n.Node; reaching proposerDoneCh instead
+	// confirms it took the stopCh path.
+	go n.runProposer()
+
+	close(n.stopCh)
+
+	select {
+	case <-n.proposerDoneCh:
+	case <-time.After(time.Second):
+		t.Fatal("runProposer did not close proposerDoneCh after stopCh was closed")
+	}
+}
+
+func TestRunProposerDoesNotCloseDoneChWhileIdle(t *testing.T) {
+	n := &Node{
+		proposeQueue:   make(chan *pendingProposal),
+		stopCh:         make(chan struct{}),
+		proposerDoneCh: make(chan struct{}),
+	}
+
+	go n.runProposer()
+	defer close(n.stopCh)
+
+	select {
+	case <-n.proposerDoneCh:
+		t.Fatal("proposerDoneCh closed before stopCh, with no proposal ever queued")
+	case <-time.After(20 * time.Millisecond):
+	}
+}
@@ -0,0 +1,126 @@
+package state
+
+import (
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/coreos/etcd/raft"
+)
+
+// compactionCheckInterval is how often the compactor samples the applied
+// index. It is intentionally much shorter than any reasonable
+// AutoCompactionRetention so the retention window is honored with
+// reasonable precision.
+const compactionCheckInterval = 5 * time.Minute
+
+// compactor compacts the raft log on a fixed time schedule, independent
+// of snapshotting, modeled on etcd's periodic compactor. It only acts
+// while the node is leader; followers still benefit from snapshot-driven
+// compaction once they receive the leader's next snapshot.
+type compactor struct {
+	n         *Node
+	retention time.Duration
+
+	mu                 sync.Mutex
+	samples            []compactorSample
+	lastCompactedIndex uint64
+
+	stopCh chan struct{}
+	doneCh chan struct{}
+}
+
+type compactorSample struct {
+	index uint64
+	at    time.Time
+}
+
+func newCompactor(n *Node, retention time.Duration) *compactor {
+	return &compactor{
+		n:         n,
+		retention: retention,
+		stopCh:    make(chan struct{}),
+		doneCh:    make(chan struct{}),
+	}
+}
+
+// Run samples the applied index every compactionCheckInterval into a
+// bounded ring buffer and, once per retention window, compacts the raft
+// log up to the index that was current one retention window ago. It
+// blocks until Stop is called.
+func (c *compactor) Run() {
+	defer close(c.doneCh)
+
+	ticker := time.NewTicker(compactionCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			c.tick()
+		case <-c.stopCh:
+			return
+		}
+	}
+}
+
+func (c *compactor) tick() {
+	if !c.n.IsLeader() {
+		// Reset: a follower has no business compacting on its own
+		// clock, and if it becomes leader later it should start the
+		// retention window fresh rather than acting on stale samples.
+		c.mu.Lock()
+		c.samples = nil
+		c.mu.Unlock()
+		return
+	}
+
+	now := time.Now()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.samples = append(c.samples, compactorSample{index: c.n.getAppliedIndex(), at: now})
+	c.samples = trimSamples(c.samples, now.Add(-c.retention))
+
+	oldest := c.samples[0]
+	if now.Sub(oldest.at) < c.retention || oldest.index <= c.lastCompactedIndex {
+		return
+	}
+
+	if err := c.n.raftStore.Compact(oldest.index); err != nil && err != raft.ErrCompacted {
+		logrus.Errorf("time-based raft log compaction to index %d failed: %v", oldest.index, err)
+		return
+	}
+
+	c.lastCompactedIndex = oldest.index
+	// Start the next retention window from the newest sample, so the next
+	// compaction happens one full window from now.
+	c.samples = c.samples[len(c.samples)-1:]
+}
+
+// trimSamples drops samples older than necessary, keeping at most one
+// sample at or before cutoff: that's the one tick will compact to once
+// the retention window is full, and older ones are never needed again.
+// samples must be sorted by time, oldest first, and non-empty.
+func trimSamples(samples []compactorSample, cutoff time.Time) []compactorSample {
+	drop := 0
+	for drop < len(samples)-1 && !samples[drop+1].at.After(cutoff) {
+		drop++
+	}
+	return samples[drop:]
+}
+
+// LastCompactedIndex returns the raft log index most recently compacted
+// by the time-based compactor, for observability.
+func (c *compactor) LastCompactedIndex() uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lastCompactedIndex
+}
+
+// Stop halts the compactor and waits for its goroutine to exit.
+func (c *compactor) Stop() {
+	close(c.stopCh)
+	<-c.doneCh
+}
@@ -0,0 +1,41 @@
+package state
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTrimSamples(t *testing.T) {
+	base := time.Unix(0, 0)
+	at := func(sec int) time.Time { return base.Add(time.Duration(sec) * time.Second) }
+
+	samples := []compactorSample{
+		{index: 1, at: at(0)},
+		{index: 2, at: at(10)},
+		{index: 3, at: at(20)},
+		{index: 4, at: at(30)},
+	}
+
+	cases := []struct {
+		name      string
+		cutoff    time.Time
+		wantFirst uint64
+		wantLen   int
+	}{
+		{name: "cutoff before every sample keeps them all", cutoff: at(-5), wantFirst: 1, wantLen: 4},
+		{name: "cutoff drops samples strictly before the last one at or before it", cutoff: at(25), wantFirst: 3, wantLen: 2},
+		{name: "cutoff past every sample keeps only the newest", cutoff: at(100), wantFirst: 4, wantLen: 1},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got := trimSamples(samples, c.cutoff)
+			if len(got) != c.wantLen {
+				t.Fatalf("len = %d, want %d", len(got), c.wantLen)
+			}
+			if got[0].index != c.wantFirst {
+				t.Fatalf("first retained index = %d, want %d", got[0].index, c.wantFirst)
+			}
+		})
+	}
+}
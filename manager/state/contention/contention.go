@@ -0,0 +1,57 @@
+// Package contention helps detect situations where a recurring event
+// (for example, a raft tick) is taking conspicuously longer between
+// occurrences than expected, which is often a symptom of disk or CPU
+// contention elsewhere in the process.
+package contention
+
+import (
+	"sync"
+	"time"
+)
+
+// TimeoutDetector observes the intervals between calls to Observe for a
+// given id and reports when an interval exceeds a configured threshold.
+type TimeoutDetector struct {
+	mu          sync.Mutex
+	maxDuration time.Duration
+	previous    map[uint64]time.Time
+}
+
+// NewTimeoutDetector creates a TimeoutDetector that flags any interval
+// between observations of the same id that is longer than maxDuration.
+func NewTimeoutDetector(maxDuration time.Duration) *TimeoutDetector {
+	return &TimeoutDetector{
+		maxDuration: maxDuration,
+		previous:    make(map[uint64]time.Time),
+	}
+}
+
+// Observe records an occurrence of id and returns the duration since the
+// previous occurrence along with whether it exceeded maxDuration. The
+// first observation of a given id is never reported as suspect.
+func (td *TimeoutDetector) Observe(id uint64) (time.Duration, bool) {
+	now := time.Now()
+
+	td.mu.Lock()
+	defer td.mu.Unlock()
+
+	var (
+		duration time.Duration
+		suspect  bool
+	)
+	if previous, ok := td.previous[id]; ok {
+		duration = now.Sub(previous)
+		suspect = duration > td.maxDuration
+	}
+	td.previous[id] = now
+
+	return duration, suspect
+}
+
+// Reset forgets the last observation for id, so the next Observe call
+// will not be compared against a stale timestamp.
+func (td *TimeoutDetector) Reset(id uint64) {
+	td.mu.Lock()
+	defer td.mu.Unlock()
+	delete(td.previous, id)
+}
@@ -0,0 +1,32 @@
+package contention
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTimeoutDetector(t *testing.T) {
+	td := NewTimeoutDetector(10 * time.Second)
+
+	if _, suspect := td.Observe(1); suspect {
+		t.Fatal("first Observe of an id must never be suspect")
+	}
+
+	td.previous[1] = time.Now().Add(-5 * time.Second)
+	if _, suspect := td.Observe(1); suspect {
+		t.Fatal("an interval within maxDuration must not be suspect")
+	}
+
+	td.previous[1] = time.Now().Add(-20 * time.Second)
+	if _, suspect := td.Observe(1); !suspect {
+		t.Fatal("an interval past maxDuration must be suspect")
+	}
+
+	td.Reset(1)
+	if _, ok := td.previous[1]; ok {
+		t.Fatal("Reset must clear the previous timestamp")
+	}
+	if _, suspect := td.Observe(1); suspect {
+		t.Fatal("the Observe following a Reset must not be compared against the stale timestamp")
+	}
+}
@@ -1,6 +1,7 @@
 package state
 
 import (
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
@@ -10,6 +11,7 @@ import (
 	"os"
 	"path/filepath"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"google.golang.org/grpc"
@@ -24,12 +26,24 @@ import (
 	"github.com/coreos/etcd/wal"
 	"github.com/coreos/etcd/wal/walpb"
 	"github.com/docker/swarm-v2/api"
+	"github.com/docker/swarm-v2/manager/state/contention"
 	"github.com/gogo/protobuf/proto"
 )
 
 const (
 	maxRequestBytes       = 1.5 * 1024 * 1024
 	defaultProposeTimeout = 10 * time.Second
+
+	// tickContentionID is the id passed to the contention detector for
+	// every tick. There's only one recurring event of interest here, so a
+	// constant id is enough to let the detector compare consecutive
+	// ticks.
+	tickContentionID = 1
+
+	// defaultMaxBatchDelay is how long the proposal batcher waits for
+	// more proposals to arrive before flushing a batch that isn't yet
+	// full, when NewNodeOptions.MaxBatchDelay isn't set.
+	defaultMaxBatchDelay = 10 * time.Millisecond
 )
 
 var (
@@ -96,12 +110,18 @@ type Node struct {
 	memoryStore *MemoryStore
 	Config      *raft.Config
 	reqIDGen    *idutil.Generator
+	memberIDGen *idutil.Generator
 	wait        *wait
 	wal         *wal.WAL
 	snapshotter *snap.Snapshotter
 	stateDir    string
 	wasLeader   bool
 
+	// joinAddr is the address of an existing cluster member to ask for a
+	// raft ID when bootstrapping, or empty if this node is founding a new
+	// cluster. See NewNodeOptions.JoinAddr.
+	joinAddr string
+
 	// snapshotInterval is the number of log messages after which a new
 	// snapshot should be generated.
 	snapshotInterval uint64
@@ -114,6 +134,39 @@ type Node struct {
 	appliedIndex  uint64
 	snapshotIndex uint64
 
+	// indexMu guards appliedIndex, snapshotIndex and stopped, and wakes up
+	// indexCond on changes so LinearizableRead/WaitAppliedIndex can block
+	// until the state machine catches up to a given raft log index.
+	indexMu   sync.Mutex
+	indexCond *sync.Cond
+
+	// stopped is set once the node begins shutting down, so
+	// WaitAppliedIndex knows to give up instead of waiting for an index
+	// that will never be applied.
+	stopped bool
+
+	// snapshotting is 1 while an asynchronous snapshot is in flight, so
+	// that at most one snapshot runs at a time and new triggers can be
+	// dropped instead of piling up behind it.
+	snapshotting         int32
+	snapshotJobs         chan snapshotJob
+	snapshotWorkerDoneCh chan struct{}
+	contentionTracker    *contention.TimeoutDetector
+
+	// slowSnapshot counts the number of times the tick loop observed a
+	// gap between ticks long enough to suggest disk contention while a
+	// snapshot was in progress on this node.
+	slowSnapshot uint64
+
+	// compactor is non-nil when AutoCompactionRetention was set,
+	// enabling time-based log compaction independent of snapshotting.
+	compactor *compactor
+
+	// proposeQueue feeds the proposal batcher; see runProposer.
+	proposeQueue   chan *pendingProposal
+	maxBatchDelay  time.Duration
+	proposerDoneCh chan struct{}
+
 	ticker *time.Ticker
 	stopCh chan struct{}
 	doneCh chan struct{}
@@ -132,6 +185,24 @@ type NewNodeOptions struct {
 	TickInterval               time.Duration
 	SnapshotInterval           uint64  // optional
 	LogEntriesForSlowFollowers *uint64 // optional; pointer because 0 is valid
+
+	// AutoCompactionRetention is how far back in time the raft log is
+	// kept before being compacted, independent of snapshotting. If zero,
+	// time-based auto-compaction is disabled and compaction only happens
+	// as a side effect of snapshotting, as before.
+	AutoCompactionRetention time.Duration
+
+	// MaxBatchDelay is how long the proposal batcher waits for more
+	// proposals to coalesce into a single raft round before flushing
+	// whatever it already has. Optional; defaults to
+	// defaultMaxBatchDelay.
+	MaxBatchDelay time.Duration
+
+	// JoinAddr is the address of an existing cluster member to join. If
+	// set, the node asks that member for a raft ID instead of picking one
+	// itself, so two aspirants can never collide on the same ID. Leave
+	// empty to bootstrap a brand-new, single-member cluster.
+	JoinAddr string
 }
 
 func init() {
@@ -148,6 +219,9 @@ func NewNode(ctx context.Context, opts NewNodeOptions, leadershipCh chan Leaders
 	if opts.TickInterval == 0 {
 		opts.TickInterval = time.Second
 	}
+	if opts.MaxBatchDelay == 0 {
+		opts.MaxBatchDelay = defaultMaxBatchDelay
+	}
 
 	raftStore := raft.NewMemoryStorage()
 
@@ -166,11 +240,22 @@ func NewNode(ctx context.Context, opts NewNodeOptions, leadershipCh chan Leaders
 		},
 		snapshotInterval:           1000,
 		logEntriesForSlowFollowers: 500,
-		ticker:       time.NewTicker(opts.TickInterval),
-		stopCh:       make(chan struct{}),
-		doneCh:       make(chan struct{}),
-		stateDir:     opts.StateDir,
-		leadershipCh: leadershipCh,
+		ticker:                     time.NewTicker(opts.TickInterval),
+		stopCh:                     make(chan struct{}),
+		doneCh:                     make(chan struct{}),
+		stateDir:                   opts.StateDir,
+		leadershipCh:               leadershipCh,
+		joinAddr:                   opts.JoinAddr,
+	}
+	n.indexCond = sync.NewCond(&n.indexMu)
+	n.snapshotJobs = make(chan snapshotJob, 1)
+	n.snapshotWorkerDoneCh = make(chan struct{})
+	n.contentionTracker = contention.NewTimeoutDetector(2 * opts.TickInterval)
+	n.proposeQueue = make(chan *pendingProposal)
+	n.maxBatchDelay = opts.MaxBatchDelay
+	n.proposerDoneCh = make(chan struct{})
+	if opts.AutoCompactionRetention > 0 {
+		n.compactor = newCompactor(n, opts.AutoCompactionRetention)
 	}
 	n.memoryStore = NewMemoryStore(n)
 
@@ -193,9 +278,10 @@ func NewNode(ctx context.Context, opts NewNodeOptions, leadershipCh chan Leaders
 	}
 
 	n.confState = snapshot.Metadata.ConfState
-	n.appliedIndex = snapshot.Metadata.Index
+	n.setAppliedIndex(snapshot.Metadata.Index)
 	n.snapshotIndex = snapshot.Metadata.Index
 	n.reqIDGen = idutil.NewGenerator(uint16(n.Config.ID), time.Now())
+	n.memberIDGen = idutil.NewGenerator(uint16(n.Config.ID), time.Now())
 
 	return n, nil
 }
@@ -217,6 +303,15 @@ func (n *Node) MemoryStore() WatchableStore {
 	return n.memoryStore
 }
 
+// ReadTx is a point-in-time read transaction against the memory store, as
+// returned by MemoryStore.BeginRead.
+type ReadTx interface {
+	// Save marshals the transaction's view of the store.
+	Save() ([]byte, error)
+	// Close releases the transaction.
+	Close()
+}
+
 func (n *Node) walDir() string {
 	return filepath.Join(n.stateDir, "wal")
 }
@@ -237,9 +332,26 @@ func (n *Node) loadAndStart() error {
 	n.snapshotter = snap.New(snapDir)
 
 	if !wal.Exist(walDir) {
-		// FIXME(aaronl): Generate unique ID on remote side if joining
-		// an existing cluster.
-		n.Config.ID = uint64(rand.Int63()) + 1
+		var members []*api.RaftNode
+		if n.joinAddr != "" {
+			// Ask an existing member to allocate our ID and add us to the
+			// cluster before we ever touch the WAL. Picking our own ID
+			// locally, as used to happen here unconditionally, allowed
+			// two aspirants to randomly collide on the same one and
+			// silently corrupt the cluster; see Node.Join.
+			id, existing, err := n.joinCluster()
+			if err != nil {
+				return fmt.Errorf("join cluster error: %v", err)
+			}
+			n.Config.ID = id
+			members = existing
+		} else {
+			// Picking our own ID here is only safe because this path
+			// runs exclusively for the founding member of a brand-new
+			// cluster, which by definition has no other members to
+			// collide with.
+			n.Config.ID = uint64(rand.Int63()) + 1
+		}
 
 		raftNode := &api.RaftNode{
 			ID:   n.Config.ID,
@@ -256,6 +368,18 @@ func (n *Node) loadAndStart() error {
 
 		n.cluster.AddMember(&Member{RaftNode: raftNode})
 
+		if n.joinAddr != "" {
+			if err := n.RegisterNodes(members); err != nil {
+				return fmt.Errorf("error registering existing cluster members: %v", err)
+			}
+			// The ConfChange that adds us already went through consensus
+			// as part of Join; we'll pick it up over the wire like any
+			// other raft message once we start, so we join with no
+			// peers of our own.
+			n.Node = raft.StartNode(n.Config, nil)
+			return nil
+		}
+
 		n.Node = raft.StartNode(n.Config, []raft.Peer{{ID: n.Config.ID}})
 		return nil
 	}
@@ -353,10 +477,35 @@ func (n *Node) Start() (errCh <-chan error) {
 	n.wait = newWait()
 	var err error
 	n.errCh = make(chan error)
+
+	// Wake up anyone blocked in WaitAppliedIndex once the node stops.
+	go func() {
+		<-n.stopCh
+		n.indexMu.Lock()
+		n.stopped = true
+		n.indexCond.Broadcast()
+		n.indexMu.Unlock()
+	}()
+
+	go n.runSnapshotWorker()
+	go n.runProposer()
+
+	if n.compactor != nil {
+		go n.compactor.Run()
+	}
+
 	go func() {
 		for {
 			select {
 			case <-n.ticker.C:
+				if atomic.LoadInt32(&n.snapshotting) == 1 {
+					if _, suspect := n.contentionTracker.Observe(tickContentionID); suspect {
+						logrus.Warning("raft: tick took longer than expected while a snapshot was in progress; server is likely overloaded")
+						atomic.AddUint64(&n.slowSnapshot, 1)
+					}
+				} else {
+					n.contentionTracker.Reset(tickContentionID)
+				}
 				n.Tick()
 
 			case rd := <-n.Ready():
@@ -378,8 +527,8 @@ func (n *Node) Start() (errCh <-chan error) {
 					if err := n.memoryStore.Restore(rd.Snapshot.Data); err != nil {
 						n.errCh <- err
 					}
-					n.appliedIndex = rd.Snapshot.Metadata.Index
-					n.snapshotIndex = rd.Snapshot.Metadata.Index
+					n.setAppliedIndex(rd.Snapshot.Metadata.Index)
+					n.setSnapshotIndex(rd.Snapshot.Metadata.Index)
 					n.confState = rd.Snapshot.Metadata.ConfState
 				}
 
@@ -390,9 +539,20 @@ func (n *Node) Start() (errCh <-chan error) {
 					}
 				}
 
+				// Correlate ReadIndex responses with the requests that
+				// triggered them, so LinearizableRead callers waiting on
+				// n.wait learn which applied index they need to observe.
+				for _, rs := range rd.ReadStates {
+					if len(rs.RequestCtx) != 8 {
+						continue
+					}
+					id := binary.BigEndian.Uint64(rs.RequestCtx)
+					n.wait.trigger(id, rs.Index)
+				}
+
 				// Trigger a snapshot every once in awhile
-				if n.appliedIndex-n.snapshotIndex >= n.snapshotInterval {
-					if err := n.doSnapshot(); err != nil {
+				if n.getAppliedIndex()-n.getSnapshotIndex() >= n.snapshotInterval {
+					if err := n.triggerSnapshot(); err != nil {
 						n.errCh <- err
 					}
 				}
@@ -422,7 +582,20 @@ func (n *Node) Start() (errCh <-chan error) {
 				n.Advance()
 
 			case <-n.stopCh:
+				if n.compactor != nil {
+					n.compactor.Stop()
+				}
 				n.sends.Wait()
+				// The proposer may be mid-submitBatch, calling
+				// n.IsLeader()/n.Propose() on n.Node; wait for it to
+				// notice stopCh and return before nilling n.Node out
+				// from under it.
+				<-n.proposerDoneCh
+				// A snapshot may already be mid-write on the worker
+				// goroutine, via n.wal.SaveSnapshot/n.snapshotter.SaveSnap/
+				// n.wal.ReleaseLockTo; wait for it to finish before
+				// closing the WAL out from under it.
+				<-n.snapshotWorkerDoneCh
 				n.Stop()
 				n.wal.Close()
 				n.Node = nil
@@ -450,6 +623,24 @@ func (n *Node) IsLeader() bool {
 	return false
 }
 
+// LastCompactedIndex returns the raft log index most recently compacted
+// by the time-based auto-compactor, or 0 if AutoCompactionRetention was
+// not configured or no compaction has run yet.
+func (n *Node) LastCompactedIndex() uint64 {
+	if n.compactor == nil {
+		return 0
+	}
+	return n.compactor.LastCompactedIndex()
+}
+
+// SlowSnapshot returns the number of times this node's tick loop observed
+// a gap between ticks long enough to suggest disk contention while a
+// snapshot was in progress. Operators can sample it to decide whether
+// snapshotInterval needs tuning.
+func (n *Node) SlowSnapshot() uint64 {
+	return atomic.LoadUint64(&n.slowSnapshot)
+}
+
 // Leader returns the id of the leader
 func (n *Node) Leader() uint64 {
 	return n.Node.Status().Lead
@@ -458,29 +649,62 @@ func (n *Node) Leader() uint64 {
 // Join asks to a member of the raft to propose
 // a configuration change and add us as a member thus
 // beginning the log replication process. This method
-// is called from an aspiring member to an existing member
+// is called from an aspiring member to an existing member.
+//
+// The aspirant is expected to leave req.Node.ID unset (0): letting each
+// side pick its own ID, as used to happen here, allowed two aspirants to
+// randomly collide on the same ID and silently corrupt the cluster. The
+// member that receives the Join allocates the ID from its own memberIDGen
+// and hands it back in the response; Join does not check that this member
+// is the leader. The aspirant persists that ID in its WAL metadata the
+// first time it calls wal.Create. A non-zero req.Node.ID is still
+// accepted for compatibility with older clients, but only after
+// confirming it isn't already taken.
+//
+// A retried Join for an address that already holds a membership (for
+// example because the aspirant timed out waiting for the first Join's
+// response after the leader had already committed the ConfChange)
+// reuses that membership's ID instead of minting a new one, so the
+// retry doesn't leave two cluster members pointing at the same address.
 func (n *Node) Join(ctx context.Context, req *api.JoinRequest) (*api.JoinResponse, error) {
-	meta, err := req.Node.Marshal()
-	if err != nil {
-		return nil, err
-	}
-
 	if n.cluster.IsIDRemoved(req.Node.ID) {
 		return nil, ErrIDRemoved
 	}
 
+	id := req.Node.ID
+	if id == 0 {
+		for _, member := range n.cluster.Members() {
+			if member.Addr == req.Node.Addr {
+				id = member.ID
+				break
+			}
+		}
+		if id == 0 {
+			id = n.newMemberID()
+		}
+	} else if n.cluster.GetMember(id) != nil {
+		return nil, ErrIDExists
+	}
+
+	node := *req.Node
+	node.ID = id
+
+	meta, err := node.Marshal()
+	if err != nil {
+		return nil, err
+	}
+
 	// We submit a configuration change only if the node was not registered yet
 	// TODO(abronan, aaronl): determine if we need to snapshot the memberlist
-	if n.cluster.GetMember(req.Node.ID) == nil {
+	if n.cluster.GetMember(id) == nil {
 		cc := raftpb.ConfChange{
 			Type:    raftpb.ConfChangeAddNode,
-			NodeID:  req.Node.ID,
+			NodeID:  id,
 			Context: meta,
 		}
 
 		// Wait for a raft round to process the configuration change
-		err = n.configure(ctx, cc)
-		if err != nil {
+		if err := n.configure(ctx, cc); err != nil {
 			return nil, err
 		}
 	}
@@ -494,7 +718,40 @@ func (n *Node) Join(ctx context.Context, req *api.JoinRequest) (*api.JoinRespons
 	}
 
 	// TODO(aaronl): send back store snapshot after join?
-	return &api.JoinResponse{Members: nodes}, nil
+	return &api.JoinResponse{Members: nodes, RaftID: id}, nil
+}
+
+// newMemberID allocates an ID for a joining member, retrying on the rare
+// chance that memberIDGen produces a value already in use by a current or
+// formerly-removed member.
+func (n *Node) newMemberID() uint64 {
+	for {
+		id := n.memberIDGen.Next()
+		if id != 0 && n.cluster.GetMember(id) == nil && !n.cluster.IsIDRemoved(id) {
+			return id
+		}
+	}
+}
+
+// joinCluster dials n.joinAddr and asks the member there to add us to the
+// cluster, returning the ID it allocated for us along with the current
+// member list. It runs once, before the WAL exists, as part of
+// loadAndStart.
+func (n *Node) joinCluster() (uint64, []*api.RaftNode, error) {
+	client, err := GetRaftClient(n.joinAddr, defaultProposeTimeout)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(n.Ctx, defaultProposeTimeout)
+	defer cancel()
+
+	resp, err := client.Join(ctx, &api.JoinRequest{Node: &api.RaftNode{Addr: n.Address}})
+	if err != nil {
+		return 0, nil, err
+	}
+
+	return resp.RaftID, resp.Members, nil
 }
 
 // Leave asks to a member of the raft to remove
@@ -530,6 +787,42 @@ func (n *Node) ProcessRaftMessage(ctx context.Context, msg *api.ProcessRaftMessa
 	return &api.ProcessRaftMessageResponse{}, nil
 }
 
+// SendSnapshot is the receiving half of the streaming snapshot transport.
+// A snapshot of the memory store can easily exceed maxRequestBytes, which
+// rules out sending it through the unary ProcessRaftMessage call along
+// with every other raft message, so sendSnapshot splits it into
+// fixed-size frames on a dedicated stream and this reassembles them
+// before stepping the message into the local raft state machine.
+func (n *Node) SendSnapshot(stream api.Raft_SendSnapshotServer) error {
+	req, err := stream.Recv()
+	if err != nil {
+		return err
+	}
+	if req.Header == nil {
+		return fmt.Errorf("raft: first SendSnapshot frame must carry the message header")
+	}
+
+	msg := *req.Header
+	var data []byte
+	for {
+		req, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		data = append(data, req.Chunk...)
+	}
+	msg.Snapshot.Data = data
+
+	if err := n.Step(n.Ctx, msg); err != nil {
+		return err
+	}
+
+	return stream.SendAndClose(&api.SendSnapshotResponse{})
+}
+
 // RegisterNode registers a new node on the cluster
 func (n *Node) RegisterNode(node *api.RaftNode) error {
 	// Avoid opening a connection with ourself
@@ -595,6 +888,109 @@ func (n *Node) ProposeValue(ctx context.Context, storeAction []*api.StoreAction,
 	return nil
 }
 
+// LinearizableRead blocks until it can guarantee that any subsequent read
+// of the memory store will observe every StoreAction committed at the
+// time LinearizableRead was called. It does this by obtaining a read
+// index from the raft leader (forwarding the request over the existing
+// message transport if this node is a follower) and then waiting for the
+// local applied index to catch up to it.
+func (n *Node) LinearizableRead(ctx context.Context) error {
+	readIndex, err := n.requestReadIndex(ctx)
+	if err != nil {
+		return err
+	}
+
+	return n.WaitAppliedIndex(ctx, readIndex)
+}
+
+// requestReadIndex submits a ReadIndex request to raft and waits for the
+// corresponding ReadState to come back through the Ready() loop. If this
+// node is a follower, raft routes the underlying MsgReadIndex to the
+// leader the same way it routes any other raft message, through send().
+func (n *Node) requestReadIndex(ctx context.Context) (uint64, error) {
+	id := n.reqIDGen.Next()
+	ch := n.wait.register(id, nil)
+
+	var reqCtx [8]byte
+	binary.BigEndian.PutUint64(reqCtx[:], id)
+
+	if err := n.ReadIndex(ctx, reqCtx[:]); err != nil {
+		n.wait.cancel(id)
+		return 0, err
+	}
+
+	select {
+	case x, ok := <-ch:
+		if !ok {
+			return 0, ErrLostLeadership
+		}
+		return x.(uint64), nil
+	case <-ctx.Done():
+		n.wait.cancel(id)
+		return 0, ctx.Err()
+	case <-n.stopCh:
+		n.wait.cancel(id)
+		return 0, ErrStopped
+	}
+}
+
+// WaitAppliedIndex blocks the calling goroutine until the local applied
+// index reaches idx, the node is stopped, or ctx is done, whichever
+// happens first. Store consumers that already know the index they need
+// to observe (for example, after a successful LinearizableRead) can call
+// this directly.
+func (n *Node) WaitAppliedIndex(ctx context.Context, idx uint64) error {
+	// sync.Cond has no way to select on ctx.Done(), so give cancellation
+	// a way in: broadcast (to every waiter, not just this one, same as
+	// the node-stopped case below) when ctx is done, and let the loop's
+	// own ctx.Err() check notice it.
+	if done := ctx.Done(); done != nil {
+		stop := make(chan struct{})
+		defer close(stop)
+		go func() {
+			select {
+			case <-done:
+				n.indexMu.Lock()
+				n.indexCond.Broadcast()
+				n.indexMu.Unlock()
+			case <-stop:
+			}
+		}()
+	}
+
+	n.indexMu.Lock()
+	defer n.indexMu.Unlock()
+	for n.appliedIndex < idx {
+		if n.stopped {
+			return ErrStopped
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		n.indexCond.Wait()
+	}
+	return nil
+}
+
+// getAppliedIndex returns the most recently applied raft log index. Safe
+// to call from any goroutine.
+func (n *Node) getAppliedIndex() uint64 {
+	n.indexMu.Lock()
+	defer n.indexMu.Unlock()
+	return n.appliedIndex
+}
+
+// setAppliedIndex updates the applied index and wakes up any goroutines
+// blocked in WaitAppliedIndex. Apart from the initial value set by
+// NewNode, it must only be called from the main Start() loop, which is
+// the sole writer of appliedIndex once the node is running.
+func (n *Node) setAppliedIndex(idx uint64) {
+	n.indexMu.Lock()
+	n.appliedIndex = idx
+	n.indexMu.Unlock()
+	n.indexCond.Broadcast()
+}
+
 // Saves a log entry to our Store
 func (n *Node) saveToStorage(hardState raftpb.HardState, entries []raftpb.Entry, snapshot raftpb.Snapshot) (err error) {
 	if !raft.IsEmptySnap(snapshot) {
@@ -638,23 +1034,74 @@ func (n *Node) saveSnapshot(snapshot raftpb.Snapshot) error {
 	return nil
 }
 
-func (n *Node) doSnapshot() error {
-	// TODO(aaronl): This should be made async
-	// TODO(aaronl): Should probably disable snapshotting while a
-	// previous snapshot is in-flight to followers.
-	d, err := n.memoryStore.Save()
+// snapshotJob carries a snapshot request from triggerSnapshot to
+// runSnapshotWorker: the raft state to record, plus a read transaction
+// pinned at appliedIndex for the worker to marshal.
+type snapshotJob struct {
+	appliedIndex uint64
+	confState    raftpb.ConfState
+	tx           ReadTx
+}
+
+// triggerSnapshot pins a read transaction against the memory store and
+// hands it, with the current applied index, to the snapshot worker. It
+// never blocks: a trigger while a snapshot is already in flight is simply
+// dropped.
+func (n *Node) triggerSnapshot() error {
+	if !atomic.CompareAndSwapInt32(&n.snapshotting, 0, 1) {
+		return nil
+	}
+
+	tx, err := n.memoryStore.BeginRead()
+	if err != nil {
+		atomic.StoreInt32(&n.snapshotting, 0)
+		return err
+	}
+
+	n.snapshotJobs <- snapshotJob{
+		appliedIndex: n.getAppliedIndex(),
+		confState:    n.confState,
+		tx:           tx,
+	}
+	return nil
+}
+
+// runSnapshotWorker marshals and persists snapshots off the main Ready()
+// loop, one at a time. It closes snapshotWorkerDoneCh on exit so Shutdown
+// can wait for a snapshot in flight to finish before closing the WAL.
+func (n *Node) runSnapshotWorker() {
+	defer close(n.snapshotWorkerDoneCh)
+
+	for {
+		select {
+		case job := <-n.snapshotJobs:
+			if err := n.doSnapshot(job); err != nil {
+				n.errCh <- err
+			}
+			atomic.StoreInt32(&n.snapshotting, 0)
+		case <-n.stopCh:
+			return
+		}
+	}
+}
+
+func (n *Node) doSnapshot(job snapshotJob) error {
+	defer job.tx.Close()
+
+	data, err := job.tx.Save()
 	if err != nil {
 		return err
 	}
-	snap, err := n.raftStore.CreateSnapshot(n.appliedIndex, &n.confState, d)
+
+	snap, err := n.raftStore.CreateSnapshot(job.appliedIndex, &job.confState, data)
 	if err == nil {
 		if err := n.saveSnapshot(snap); err != nil {
 			return err
 		}
-		n.snapshotIndex = n.appliedIndex
+		n.setSnapshotIndex(job.appliedIndex)
 
-		if n.appliedIndex > n.logEntriesForSlowFollowers {
-			err := n.raftStore.Compact(n.appliedIndex - n.logEntriesForSlowFollowers)
+		if job.appliedIndex > n.logEntriesForSlowFollowers {
+			err := n.raftStore.Compact(job.appliedIndex - n.logEntriesForSlowFollowers)
 			if err != nil && err != raft.ErrCompacted {
 				return err
 			}
@@ -666,6 +1113,22 @@ func (n *Node) doSnapshot() error {
 	return nil
 }
 
+// getSnapshotIndex returns the raft log index of the most recently
+// completed snapshot. Safe to call from any goroutine.
+func (n *Node) getSnapshotIndex() uint64 {
+	n.indexMu.Lock()
+	defer n.indexMu.Unlock()
+	return n.snapshotIndex
+}
+
+// setSnapshotIndex records the raft log index of the most recently
+// completed snapshot.
+func (n *Node) setSnapshotIndex(idx uint64) {
+	n.indexMu.Lock()
+	n.snapshotIndex = idx
+	n.indexMu.Unlock()
+}
+
 // Sends a series of messages to members in the raft
 func (n *Node) send(messages []raftpb.Message) error {
 	members := n.cluster.Members()
@@ -692,7 +1155,19 @@ func (n *Node) send(messages []raftpb.Message) error {
 }
 
 func (n *Node) sendToMember(ctx context.Context, member *Member, m raftpb.Message) {
-	_, err := member.Client.ProcessRaftMessage(ctx, &api.ProcessRaftMessageRequest{Msg: &m})
+	var err error
+	if m.Type == raftpb.MsgSnap {
+		// The ctx passed in here carries the 2s deadline send() uses for
+		// ordinary raft messages, which is far too short for a large
+		// snapshot transferred over several chunked frames. Give the
+		// whole stream its own timeout instead, independent of that one.
+		snapCtx, cancel := context.WithTimeout(n.Ctx, snapshotSendTimeout)
+		defer cancel()
+		err = n.sendSnapshot(snapCtx, member, m)
+	} else {
+		_, err = member.Client.ProcessRaftMessage(ctx, &api.ProcessRaftMessageRequest{Msg: &m})
+	}
+
 	if err != nil {
 		if m.Type == raftpb.MsgSnap {
 			n.ReportSnapshot(m.To, raft.SnapshotFailure)
@@ -710,6 +1185,59 @@ func (n *Node) sendToMember(ctx context.Context, member *Member, m raftpb.Messag
 	n.sends.Done()
 }
 
+// snapshotChunkSize is the maximum amount of snapshot data carried by a
+// single SendSnapshot stream frame.
+const snapshotChunkSize = 512 * 1024
+
+// chunkSnapshotData splits data into frames of at most snapshotChunkSize
+// bytes, the same split sendSnapshot streams to a follower. The receiving
+// end in SendSnapshot reassembles them by simple concatenation, in order.
+func chunkSnapshotData(data []byte) [][]byte {
+	var chunks [][]byte
+	for len(data) > 0 {
+		n := snapshotChunkSize
+		if n > len(data) {
+			n = len(data)
+		}
+		chunks = append(chunks, data[:n])
+		data = data[n:]
+	}
+	return chunks
+}
+
+// snapshotSendTimeout bounds an entire SendSnapshot stream (open, every
+// chunked frame, and CloseAndRecv), as opposed to the 2s per-message
+// timeout send() uses for ordinary raft messages. It needs to be large
+// enough to cover a store snapshot far bigger than maxRequestBytes, which
+// is the whole point of the streaming transport.
+const snapshotSendTimeout = 10 * time.Minute
+
+// sendSnapshot streams m, a MsgSnap, to member over the SendSnapshot RPC
+// instead of the unary ProcessRaftMessage call, chunking the snapshot
+// data so it isn't subject to the maxRequestBytes limit enforced on the
+// unary path.
+func (n *Node) sendSnapshot(ctx context.Context, member *Member, m raftpb.Message) error {
+	stream, err := member.Client.SendSnapshot(ctx)
+	if err != nil {
+		return err
+	}
+
+	header := m
+	header.Snapshot.Data = nil
+	if err := stream.Send(&api.SendSnapshotRequest{Header: &header}); err != nil {
+		return err
+	}
+
+	for _, chunk := range chunkSnapshotData(m.Snapshot.Data) {
+		if err := stream.Send(&api.SendSnapshotRequest{Chunk: chunk}); err != nil {
+			return err
+		}
+	}
+
+	_, err = stream.CloseAndRecv()
+	return err
+}
+
 type applyResult struct {
 	resp proto.Message
 	err  error
@@ -721,6 +1249,14 @@ type applyResult struct {
 func (n *Node) processInternalRaftRequest(ctx context.Context, r *api.InternalRaftRequest, cb func()) (proto.Message, error) {
 	r.ID = n.reqIDGen.Next()
 
+	// Check this up front, per request, so a request that would never
+	// fit stays rejected the same way regardless of what it ends up
+	// batched with.
+	record := &api.RaftRequestRecord{ID: r.ID, Action: r.Action}
+	if record.Size() > maxRequestBytes {
+		return nil, ErrRequestTooLarge
+	}
+
 	ch := n.wait.register(r.ID, cb)
 
 	// Do this check after calling register to avoid a race.
@@ -729,21 +1265,14 @@ func (n *Node) processInternalRaftRequest(ctx context.Context, r *api.InternalRa
 		return nil, ErrLostLeadership
 	}
 
-	data, err := r.Marshal()
-	if err != nil {
-		n.wait.cancel(r.ID)
-		return nil, err
-	}
-
-	if len(data) > maxRequestBytes {
+	select {
+	case n.proposeQueue <- &pendingProposal{id: r.ID, action: r.Action}:
+	case <-ctx.Done():
 		n.wait.cancel(r.ID)
-		return nil, ErrRequestTooLarge
-	}
-
-	err = n.Propose(ctx, data)
-	if err != nil {
+		return nil, ctx.Err()
+	case <-n.stopCh:
 		n.wait.cancel(r.ID)
-		return nil, err
+		return nil, ErrStopped
 	}
 
 	select {
@@ -753,6 +1282,9 @@ func (n *Node) processInternalRaftRequest(ctx context.Context, r *api.InternalRa
 			return res.resp, res.err
 		}
 		return nil, ErrLostLeadership
+	case <-ctx.Done():
+		n.wait.cancel(r.ID)
+		return nil, ctx.Err()
 	case <-n.stopCh:
 		n.wait.cancel(r.ID)
 		return nil, ErrStopped
@@ -801,32 +1333,35 @@ func (n *Node) processCommitted(entry raftpb.Entry) error {
 		n.processConfChange(entry)
 	}
 
-	n.appliedIndex = entry.Index
+	n.setAppliedIndex(entry.Index)
 	return nil
 }
 
+// processEntry applies a committed raft log entry. Since the proposal
+// batcher may have coalesced several distinct callers' proposals into a
+// single entry, it carries a list of records rather than a single
+// (id, action) pair; each is dispatched to its own original caller.
 func (n *Node) processEntry(entry raftpb.Entry) error {
 	r := &api.InternalRaftRequest{}
-	err := proto.Unmarshal(entry.Data, r)
-	if err != nil {
+	if err := proto.Unmarshal(entry.Data, r); err != nil {
 		return err
 	}
 
-	if r.Action == nil {
-		return nil
-	}
-
-	if !n.wait.trigger(r.ID, &applyResult{resp: r, err: nil}) {
-		// There was no wait on this ID, meaning we don't have a
-		// transaction in progress that would be committed to the
-		// memory store by the "trigger" call. Either a different node
-		// wrote this to raft, or we wrote it before losing the leader
-		// position and cancelling the transaction. Create a new
-		// transaction to commit the data.
+	for _, record := range r.Records {
+		if record.Action == nil {
+			continue
+		}
 
-		err := n.memoryStore.applyStoreActions(r.Action)
-		if err != nil {
-			logrus.Errorf("error applying actions from raft: %v", err)
+		if !n.wait.trigger(record.ID, &applyResult{resp: record, err: nil}) {
+			// There was no wait on this ID, meaning we don't have a
+			// transaction in progress that would be committed to the
+			// memory store by the "trigger" call. Either a different
+			// node wrote this to raft, or we wrote it before losing
+			// the leader position and cancelling the transaction.
+			// Apply the data directly instead.
+			if err := n.memoryStore.applyStoreActions(record.Action); err != nil {
+				logrus.Errorf("error applying actions from raft: %v", err)
+			}
 		}
 	}
 	return nil
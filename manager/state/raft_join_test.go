@@ -0,0 +1,60 @@
+package state
+
+import (
+	"testing"
+	"time"
+
+	"github.com/coreos/etcd/pkg/idutil"
+	"github.com/docker/swarm-v2/api"
+)
+
+// idGenAt returns the sequence of ids a fresh idutil.Generator seeded with
+// (memberID, at) would produce, so a test can predict a collision instead
+// of depending on wall-clock timing.
+func idGenAt(memberID uint16, at time.Time, n int) []uint64 {
+	gen := idutil.NewGenerator(memberID, at)
+	ids := make([]uint64, n)
+	for i := range ids {
+		ids[i] = gen.Next()
+	}
+	return ids
+}
+
+func TestNewMemberIDSkipsExistingMember(t *testing.T) {
+	at := time.Unix(0, 0)
+	ids := idGenAt(1, at, 2)
+
+	n := &Node{cluster: NewCluster(), memberIDGen: idutil.NewGenerator(1, at)}
+	if err := n.cluster.AddMember(&Member{RaftNode: &api.RaftNode{ID: ids[0]}}); err != nil {
+		t.Fatalf("AddMember(%d) = %v, want nil", ids[0], err)
+	}
+
+	got := n.newMemberID()
+	if got == ids[0] {
+		t.Fatalf("newMemberID() = %d, collided with a current member", got)
+	}
+	if got != ids[1] {
+		t.Fatalf("newMemberID() = %d, want %d", got, ids[1])
+	}
+}
+
+func TestNewMemberIDSkipsRemovedMember(t *testing.T) {
+	at := time.Unix(0, 0)
+	ids := idGenAt(1, at, 2)
+
+	n := &Node{cluster: NewCluster(), memberIDGen: idutil.NewGenerator(1, at)}
+	if err := n.cluster.AddMember(&Member{RaftNode: &api.RaftNode{ID: ids[0]}}); err != nil {
+		t.Fatalf("AddMember(%d) = %v, want nil", ids[0], err)
+	}
+	if err := n.cluster.RemoveMember(ids[0]); err != nil {
+		t.Fatalf("RemoveMember(%d) = %v, want nil", ids[0], err)
+	}
+
+	got := n.newMemberID()
+	if got == ids[0] {
+		t.Fatalf("newMemberID() = %d, reused a formerly-removed id", got)
+	}
+	if got != ids[1] {
+		t.Fatalf("newMemberID() = %d, want %d", got, ids[1])
+	}
+}
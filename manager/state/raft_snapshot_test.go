@@ -0,0 +1,57 @@
+package state
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newTestSnapshotNode() *Node {
+	return &Node{
+		snapshotJobs:         make(chan snapshotJob, 1),
+		snapshotWorkerDoneCh: make(chan struct{}),
+		stopCh:               make(chan struct{}),
+	}
+}
+
+func TestTriggerSnapshotDropsWhileSnapshotInFlight(t *testing.T) {
+	n := newTestSnapshotNode()
+	atomic.StoreInt32(&n.snapshotting, 1)
+
+	if err := n.triggerSnapshot(); err != nil {
+		t.Fatalf("triggerSnapshot() = %v, want nil", err)
+	}
+
+	select {
+	case job := <-n.snapshotJobs:
+		t.Fatalf("triggerSnapshot enqueued %+v while a snapshot was already in flight", job)
+	default:
+	}
+}
+
+func TestRunSnapshotWorkerClosesDoneChOnStop(t *testing.T) {
+	n := newTestSnapshotNode()
+
+	go n.runSnapshotWorker()
+
+	close(n.stopCh)
+
+	select {
+	case <-n.snapshotWorkerDoneCh:
+	case <-time.After(time.Second):
+		t.Fatal("runSnapshotWorker did not close snapshotWorkerDoneCh after stopCh was closed")
+	}
+}
+
+func TestRunSnapshotWorkerDoesNotCloseDoneChWhileIdle(t *testing.T) {
+	n := newTestSnapshotNode()
+
+	go n.runSnapshotWorker()
+	defer close(n.stopCh)
+
+	select {
+	case <-n.snapshotWorkerDoneCh:
+		t.Fatal("snapshotWorkerDoneCh closed before stopCh, with no job ever submitted")
+	case <-time.After(20 * time.Millisecond):
+	}
+}
@@ -0,0 +1,98 @@
+package state
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+func newTestIndexNode() *Node {
+	n := &Node{stopCh: make(chan struct{})}
+	n.indexCond = sync.NewCond(&n.indexMu)
+	return n
+}
+
+func TestWaitAppliedIndexBlocksUntilApplied(t *testing.T) {
+	n := newTestIndexNode()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- n.WaitAppliedIndex(context.Background(), 5)
+	}()
+
+	select {
+	case err := <-done:
+		t.Fatalf("WaitAppliedIndex returned early with %v before the index was applied", err)
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	n.setAppliedIndex(5)
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("WaitAppliedIndex returned %v, want nil", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("WaitAppliedIndex did not unblock after setAppliedIndex reached the target")
+	}
+}
+
+func TestWaitAppliedIndexReturnsErrStoppedOnStop(t *testing.T) {
+	n := newTestIndexNode()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- n.WaitAppliedIndex(context.Background(), 5)
+	}()
+
+	time.Sleep(20 * time.Millisecond)
+
+	n.indexMu.Lock()
+	n.stopped = true
+	n.indexCond.Broadcast()
+	n.indexMu.Unlock()
+
+	select {
+	case err := <-done:
+		if err != ErrStopped {
+			t.Fatalf("WaitAppliedIndex returned %v, want ErrStopped", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("WaitAppliedIndex did not unblock after the node was marked stopped")
+	}
+}
+
+func TestWaitAppliedIndexReturnsPromptlyOnContextCancel(t *testing.T) {
+	n := newTestIndexNode()
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	done := make(chan error, 1)
+	go func() {
+		done <- n.WaitAppliedIndex(ctx, 5)
+	}()
+
+	time.Sleep(20 * time.Millisecond)
+	cancel()
+
+	select {
+	case err := <-done:
+		if err != context.Canceled {
+			t.Fatalf("WaitAppliedIndex returned %v, want context.Canceled", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("WaitAppliedIndex did not unblock promptly after context cancellation")
+	}
+}
+
+func TestWaitAppliedIndexReturnsImmediatelyIfAlreadyApplied(t *testing.T) {
+	n := newTestIndexNode()
+	n.setAppliedIndex(10)
+
+	if err := n.WaitAppliedIndex(context.Background(), 5); err != nil {
+		t.Fatalf("WaitAppliedIndex returned %v, want nil", err)
+	}
+}
@@ -0,0 +1,40 @@
+package state
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestChunkSnapshotDataRoundTrip(t *testing.T) {
+	sizes := []int{0, 1, snapshotChunkSize, snapshotChunkSize + 1, snapshotChunkSize*3 + 123}
+
+	for _, size := range sizes {
+		data := make([]byte, size)
+		for i := range data {
+			data[i] = byte(i)
+		}
+
+		chunks := chunkSnapshotData(data)
+
+		var reassembled []byte
+		for i, chunk := range chunks {
+			if i < len(chunks)-1 && len(chunk) != snapshotChunkSize {
+				t.Fatalf("size %d: chunk %d has len %d, want %d", size, i, len(chunk), snapshotChunkSize)
+			}
+			if len(chunk) > snapshotChunkSize {
+				t.Fatalf("size %d: chunk %d has len %d, want <= %d", size, i, len(chunk), snapshotChunkSize)
+			}
+			reassembled = append(reassembled, chunk...)
+		}
+
+		if !bytes.Equal(reassembled, data) {
+			t.Fatalf("size %d: reassembled data does not match original", size)
+		}
+	}
+}
+
+func TestChunkSnapshotDataEmpty(t *testing.T) {
+	if chunks := chunkSnapshotData(nil); len(chunks) != 0 {
+		t.Fatalf("chunkSnapshotData(nil) returned %d chunks, want 0", len(chunks))
+	}
+}